@@ -0,0 +1,43 @@
+package socksy5
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestChainNotifyConcurrentWrappers guards against the notify race where
+// AcceptAndRelay and Server.handleAssoc wrap AssocRequest.notify from
+// separate goroutines: a lost write must not silently drop either wrapping.
+func TestChainNotifyConcurrentWrappers(t *testing.T) {
+	r := &AssocRequest{}
+
+	var calls []string
+	var mu sync.Mutex
+	record := func(name string) func(prev func(error)) func(error) {
+		return func(prev func(error)) func(error) {
+			return func(err error) {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				if prev != nil {
+					prev(err)
+				}
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); chainNotify(r, record("a")) }()
+	go func() { defer wg.Done(); chainNotify(r, record("b")) }()
+	wg.Wait()
+
+	if r.notify == nil {
+		t.Fatal("expected notify to be set")
+	}
+	r.notify(nil)
+
+	if len(calls) != 2 {
+		t.Fatalf("expected both wrappers to run, got %v", calls)
+	}
+}
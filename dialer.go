@@ -0,0 +1,50 @@
+package socksy5
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// A Dialer establishes the outbound leg of a CONNECT request. Set
+// [Server.DefaultDialer] to have the Server dial destinations itself instead
+// of relying on the code consuming [Server.RequestChan] to attach an
+// already-dialed connection to the request — handy when that leg should go
+// over a tunnel (yamux, smux, a websocket) rather than a plain TCP dial.
+// DefaultDialer is never consulted for BIND, whose outbound leg is an
+// inbound connection the Server passively awaits, not one it dials.
+//
+// When DefaultDialer is set, external code reading a [*ConnectRequest] off
+// RequestChan is only responsible for the authorization decision
+// (Accept/Deny); dialing happens afterwards, in handleConnect, so it should
+// Accept with the zero [Addr]. The CONNECT reply itself isn't sent until
+// the dial resolves: on success the Server fills BND.ADDR in with the
+// dialed conn's local address before replying, and on failure it replies
+// RepGeneralFailure instead of the RepSucceeded the accept requested.
+type Dialer interface {
+	Dial(ctx context.Context, network string, addr Addr) (net.Conn, error)
+}
+
+// dialOutbound dials dst with s.DefaultDialer on behalf of r, logging and
+// returning false if no outbound connection could be established. The dial
+// is bounded by s.DialTimeout, if set, so a Dialer that hangs can't block
+// relay setup forever.
+func (s *Server) dialOutbound(setConn func(net.Conn), dst Addr, conn net.Conn) (ok bool) {
+	ctx := context.Background()
+	if s.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.DialTimeout)
+		defer cancel()
+	}
+
+	outbound, err := s.DefaultDialer.Dial(ctx, "tcp", dst)
+	if err != nil {
+		s.err(newOpErr("dial "+dst.String(), conn, err))
+		time.AfterFunc(PeriodClose, func() {
+			s.closeCloser(conn)
+		})
+		return false
+	}
+	setConn(outbound)
+	return true
+}
@@ -0,0 +1,59 @@
+package socksy5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+type stubDialer struct {
+	conn net.Conn
+	err  error
+}
+
+func (d *stubDialer) Dial(ctx context.Context, network string, addr Addr) (net.Conn, error) {
+	return d.conn, d.err
+}
+
+// TestDialOutboundFailure guards against dialOutbound reporting success (or
+// leaving setConn uncalled but still returning true) when the configured
+// Dialer fails — handleConnect relies on dialOutbound's return value alone
+// to decide whether a CONNECT reply should report success or failure.
+func TestDialOutboundFailure(t *testing.T) {
+	s := &Server{DefaultDialer: &stubDialer{err: errors.New("connection refused")}}
+	_, conn := dialTCPPair(t)
+	defer conn.Close()
+
+	var got net.Conn
+	ok := s.dialOutbound(func(c net.Conn) { got = c }, emptyAddr, conn)
+
+	if ok {
+		t.Fatal("dialOutbound should report failure when the Dialer errors")
+	}
+	if got != nil {
+		t.Fatal("setConn must not be called when the dial fails")
+	}
+}
+
+// TestDialOutboundSuccess guards against dialOutbound losing or
+// misreporting the dialed connection on the happy path.
+func TestDialOutboundSuccess(t *testing.T) {
+	outbound, remote := dialTCPPair(t)
+	defer outbound.Close()
+	defer remote.Close()
+
+	s := &Server{DefaultDialer: &stubDialer{conn: outbound}}
+	_, conn := dialTCPPair(t)
+	defer conn.Close()
+
+	var got net.Conn
+	ok := s.dialOutbound(func(c net.Conn) { got = c }, emptyAddr, conn)
+
+	if !ok {
+		t.Fatal("dialOutbound should report success when the Dialer succeeds")
+	}
+	if got != outbound {
+		t.Fatal("setConn should be called with the Dialer's returned conn")
+	}
+}
@@ -0,0 +1,172 @@
+package socksy5
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// KeepaliveConfig enables TCP-level keepalive and an application-level
+// liveness probe on CONNECT and BIND relays, so a relay sitting idle behind
+// a broken NAT or firewall doesn't hang around forever. Set [Server.Keepalive]
+// to a non-nil *KeepaliveConfig to turn it on.
+type KeepaliveConfig struct {
+	// Interval is how often both relay endpoints are probed. A non-positive
+	// Interval disables probing (and TCP keepalive) entirely, as if
+	// Server.Keepalive were nil.
+	Interval time.Duration
+	// Timeout bounds how long a single probe may take before the relay is
+	// considered dead and both endpoints are closed. A non-positive Timeout
+	// leaves the default probe's write deadline unset, so it only fails on
+	// a genuinely broken conn rather than on every tick.
+	Timeout time.Duration
+	// Probe checks whether conn is still alive, returning a non-nil error
+	// if it isn't. The default, used when Probe is nil, is a zero-byte
+	// Write under a Timeout write deadline.
+	Probe func(conn net.Conn) error
+}
+
+func (k *KeepaliveConfig) probe(conn net.Conn) error {
+	if k.Probe != nil {
+		return k.Probe(conn)
+	}
+	if k.Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(k.Timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := conn.Write(nil)
+	return err
+}
+
+// tcpKeepaliveConn is satisfied by [*net.TCPConn] and anything that embeds
+// a [net.Conn] capable of promoting it, e.g. a protocol-dispatch pushback
+// wrapper.
+type tcpKeepaliveConn interface {
+	SetKeepAlive(bool) error
+	SetKeepAlivePeriod(time.Duration) error
+}
+
+// enableTCPKeepalive turns on the OS-level TCP keepalive for conn, if conn
+// supports it. Non-TCP connections (e.g. a tunneled [Dialer] conn) are
+// silently left alone.
+func enableTCPKeepalive(conn net.Conn, period time.Duration) {
+	if kc, ok := conn.(tcpKeepaliveConn); ok {
+		kc.SetKeepAlive(true)
+		kc.SetKeepAlivePeriod(period)
+	}
+}
+
+// relayWriteGuard serializes a relay leg's regular writes with keepalive's
+// own probe writes to the same underlying conn. SetWriteDeadline applies to
+// the whole conn, not just whichever write called it, so without this a
+// probe tick landing while a real relay Write is blocked on a
+// slow/backpressured peer can make that in-flight Write return a spurious
+// i/o timeout and tear down an otherwise-healthy relay. A nil
+// *relayWriteGuard is valid and wraps to a no-op, for when keepalive is off.
+type relayWriteGuard struct {
+	mu sync.Mutex
+}
+
+// wrap returns rw unchanged if g is nil, otherwise an [io.ReadWriter] whose
+// Reads pass straight through and whose Writes are serialized with g's
+// probe via g's mutex.
+func (g *relayWriteGuard) wrap(rw io.ReadWriter) io.ReadWriter {
+	if g == nil {
+		return rw
+	}
+	return struct {
+		io.Reader
+		io.Writer
+	}{rw, &guardedWriter{Writer: rw, g: g}}
+}
+
+type guardedWriter struct {
+	io.Writer
+	g *relayWriteGuard
+}
+
+func (gw *guardedWriter) Write(p []byte) (int, error) {
+	gw.g.mu.Lock()
+	defer gw.g.mu.Unlock()
+	return gw.Writer.Write(p)
+}
+
+// watchRelayKeepalive starts probing a and b every k.Interval, closing both
+// via closeCloser if either side fails to respond, and returns a channel
+// the caller must close once the relay itself ends so the watcher can
+// stop, plus a [relayWriteGuard] for each side that the caller must use to
+// wrap the writer it hands to [Server.relay] for that side, so the probe
+// above and the relay's real traffic never race for the same conn's write
+// deadline. It is a no-op, returning an already-usable channel and nil
+// guards, if s.Keepalive is nil or its Interval isn't positive —
+// [time.NewTicker] panics on a non-positive duration, and Interval is easy
+// to leave at its zero value when only Timeout is set.
+func (s *Server) watchRelayKeepalive(a, b net.Conn) (done chan struct{}, ga, gb *relayWriteGuard) {
+	done = make(chan struct{})
+	if s.Keepalive == nil || s.Keepalive.Interval <= 0 {
+		return done, nil, nil
+	}
+
+	enableTCPKeepalive(a, s.Keepalive.Interval)
+	enableTCPKeepalive(b, s.Keepalive.Interval)
+
+	ga = &relayWriteGuard{}
+	gb = &relayWriteGuard{}
+
+	probe := func(g *relayWriteGuard, conn net.Conn) error {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return s.Keepalive.probe(conn)
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.Keepalive.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := probe(ga, a); err != nil {
+					s.warn(newOpErr("keepalive probe "+relay2str(a, b), a, err))
+					s.closeCloser(a)
+					s.closeCloser(b)
+					return
+				}
+				if err := probe(gb, b); err != nil {
+					s.warn(newOpErr("keepalive probe "+relay2str(a, b), b, err))
+					s.closeCloser(a)
+					s.closeCloser(b)
+					return
+				}
+			}
+		}
+	}()
+
+	return done, ga, gb
+}
+
+// idleReadWriter wraps an [io.ReadWriter], resetting deadlineConn's read
+// deadline before every Read so an idle relay leg can be torn down instead
+// of leaking its goroutines forever.
+type idleReadWriter struct {
+	io.ReadWriter
+	deadlineConn net.Conn
+	timeout      time.Duration
+}
+
+func (rw *idleReadWriter) Read(p []byte) (int, error) {
+	rw.deadlineConn.SetReadDeadline(time.Now().Add(rw.timeout))
+	return rw.ReadWriter.Read(p)
+}
+
+// wrapRelayIdle wraps rw so its reads reset deadlineConn's read deadline to
+// s.RelayIdleTimeout. It returns rw unchanged if no idle timeout is set.
+func (s *Server) wrapRelayIdle(rw io.ReadWriter, deadlineConn net.Conn) io.ReadWriter {
+	if s.RelayIdleTimeout <= 0 {
+		return rw
+	}
+	return &idleReadWriter{ReadWriter: rw, deadlineConn: deadlineConn, timeout: s.RelayIdleTimeout}
+}
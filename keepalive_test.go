@@ -0,0 +1,129 @@
+package socksy5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// deadlineCountConn wraps a net.Conn, counting SetReadDeadline calls so
+// tests can assert wrapRelayIdle actually resets it on every Read.
+type deadlineCountConn struct {
+	net.Conn
+	deadlines int
+}
+
+func (c *deadlineCountConn) SetReadDeadline(t time.Time) error {
+	c.deadlines++
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestWrapRelayIdleNoTimeout(t *testing.T) {
+	s := &Server{}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	if rw := s.wrapRelayIdle(a, a); rw != a {
+		t.Fatal("wrapRelayIdle should return rw unchanged when RelayIdleTimeout is unset")
+	}
+}
+
+func TestWrapRelayIdleResetsDeadlineOnRead(t *testing.T) {
+	s := &Server{RelayIdleTimeout: time.Minute}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	dc := &deadlineCountConn{Conn: a}
+	rw := s.wrapRelayIdle(dc, dc)
+
+	go b.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := rw.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if dc.deadlines != 1 {
+		t.Fatalf("expected 1 SetReadDeadline call, got %d", dc.deadlines)
+	}
+}
+
+// TestWatchRelayKeepaliveZeroIntervalNoPanic guards against
+// KeepaliveConfig{Timeout: ...} (Interval left at its zero value)
+// panicking time.NewTicker's documented "non-positive duration" panic
+// instead of treating probing as disabled.
+func TestWatchRelayKeepaliveZeroIntervalNoPanic(t *testing.T) {
+	s := &Server{Keepalive: &KeepaliveConfig{Timeout: time.Second}}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done, _, _ := s.watchRelayKeepalive(a, b)
+	close(done)
+}
+
+// TestRelayWriteGuardSerializesWithProbe guards against a keepalive probe
+// tick and a real relay Write racing for the same conn's write deadline: a
+// Write started while the probe holds the guard must not proceed until the
+// probe (and its SetWriteDeadline/clear pair) has finished.
+func TestRelayWriteGuardSerializesWithProbe(t *testing.T) {
+	var g relayWriteGuard
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	g.mu.Lock()
+	writeDone := make(chan struct{})
+	go func() {
+		w := g.wrap(a)
+		w.Write([]byte("x"))
+		close(writeDone)
+	}()
+
+	select {
+	case <-writeDone:
+		t.Fatal("guarded Write proceeded while the guard's mutex was held")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	go b.Read(make([]byte, 1))
+	g.mu.Unlock()
+
+	select {
+	case <-writeDone:
+	case <-time.After(time.Second):
+		t.Fatal("guarded Write never proceeded after the guard was released")
+	}
+}
+
+// TestRelayWriteGuardNilIsNoOp guards against a nil *relayWriteGuard (the
+// disabled-keepalive case) panicking instead of passing rw through
+// unwrapped.
+func TestRelayWriteGuardNilIsNoOp(t *testing.T) {
+	var g *relayWriteGuard
+	a, _ := net.Pipe()
+	defer a.Close()
+
+	if rw := g.wrap(a); rw != a {
+		t.Fatal("a nil relayWriteGuard should wrap to rw unchanged")
+	}
+}
+
+// TestKeepaliveConfigProbeZeroTimeout guards against the documented default
+// probe ("a zero-byte Write under a Timeout write deadline") failing every
+// single call when Timeout is left at its zero value, since
+// SetWriteDeadline(time.Now().Add(0)) makes any subsequent Write — even a
+// 0-byte one — return an i/o timeout error.
+func TestKeepaliveConfigProbeZeroTimeout(t *testing.T) {
+	k := &KeepaliveConfig{Interval: time.Second}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// A net.Pipe Write, even a zero-byte one, completes only once the peer
+	// reads it.
+	go b.Read(make([]byte, 1))
+	if err := k.probe(a); err != nil {
+		t.Fatalf("probe with zero Timeout should not fail, got: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package socksy5
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits caps the load a [Server] will accept, so it can't be trivially
+// exhausted by a flood of connections. Set [Server.Limits] before
+// [Server.Start] to enable enforcement; a nil Limits (the default) imposes
+// no caps, matching the Server's prior unbounded behavior.
+type Limits struct {
+	// MaxConcurrent caps the number of connections being served (from
+	// accept through the end of any relay) at once. Zero means no cap.
+	MaxConcurrent int
+
+	// MaxPerSourceIP caps concurrent connections from a single source IP.
+	// Zero means no cap.
+	MaxPerSourceIP int
+
+	// AcceptRate throttles how fast new connections are accepted. Zero
+	// means no throttling.
+	AcceptRate rate.Limit
+
+	// HandshakeTimeout bounds how long a client has to complete the
+	// SOCKS5 method negotiation and subnegotiation before the connection
+	// is closed outright. Zero means no timeout, leaving only the
+	// existing [PeriodAutoDeny] behavior at the request stage.
+	HandshakeTimeout time.Duration
+}
+
+// Stats are a [Server]'s live counters, exposed so operators can wire
+// Prometheus or similar without patching the library.
+type Stats struct {
+	ActiveHandshakes int64
+	ActiveConnects   int64
+	ActiveBinds      int64
+	ActiveAssocs     int64
+	// BytesRelayed grows only when one direction of a CONNECT or BIND
+	// relay finishes copying; bytes of a direction still in progress are
+	// not yet counted.
+	BytesRelayed int64
+}
+
+// Stats returns a snapshot of this Server's live counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		ActiveHandshakes: atomic.LoadInt64(&s.statHandshakes),
+		ActiveConnects:   atomic.LoadInt64(&s.statConnects),
+		ActiveBinds:      atomic.LoadInt64(&s.statBinds),
+		ActiveAssocs:     atomic.LoadInt64(&s.statAssocs),
+		BytesRelayed:     atomic.LoadInt64(&s.statBytes),
+	}
+}
+
+// connRelease defers releasing an admitted connection's Limits slot until
+// whatever actually keeps it alive is done with it. dispatch/serveClient
+// hold one per accepted connection and release it via done() once they
+// return — but handleConnect/handleBind/handleAssoc hand relay or
+// association work off to a goroutine or callback that outlives their own
+// return, so they call handoff() to take over releasing the slot
+// themselves, from the same callback that already tracks
+// statConnects/statBinds/statAssocs. Without this, the slot freed the
+// instant the SOCKS5 request was answered rather than when the relay
+// actually ended, so MaxConcurrent/MaxPerSourceIP bounded handshake
+// throughput instead of concurrent relay load.
+type connRelease struct {
+	release func()
+	handed  bool
+}
+
+// handoff marks the slot as owned by async relay/association work, so
+// done() becomes a no-op, and returns the release func for that work to
+// call exactly once when it actually finishes.
+func (cr *connRelease) handoff() func() {
+	cr.handed = true
+	return cr.release
+}
+
+// done releases the slot unless it's been handed off.
+func (cr *connRelease) done() {
+	if !cr.handed {
+		cr.release()
+	}
+}
+
+// admitConn decides whether to accept conn under s.Limits, reserving its
+// slot in the concurrent/per-source-IP counters if so. Every conn admitted
+// must be paired with a call to releaseConn once it's done being served,
+// including any relay or association the request spawns — see
+// [connRelease].
+func (s *Server) admitConn(conn *net.TCPConn) bool {
+	lim := s.Limits
+	if lim == nil {
+		return true
+	}
+
+	if s.acceptLimiter != nil && !s.acceptLimiter.Allow() {
+		return false
+	}
+
+	host := sourceIP(conn)
+
+	s.limitMux.Lock()
+	defer s.limitMux.Unlock()
+
+	if lim.MaxConcurrent > 0 && s.activeConns >= lim.MaxConcurrent {
+		return false
+	}
+	if lim.MaxPerSourceIP > 0 && s.perSourceIP[host] >= lim.MaxPerSourceIP {
+		return false
+	}
+
+	s.activeConns++
+	if s.perSourceIP == nil {
+		s.perSourceIP = make(map[string]int)
+	}
+	s.perSourceIP[host]++
+	return true
+}
+
+// releaseConn releases the slot conn was admitted under. It is a no-op if
+// s.Limits is nil, matching admitConn always allowing in that case.
+func (s *Server) releaseConn(conn *net.TCPConn) {
+	if s.Limits == nil {
+		return
+	}
+
+	host := sourceIP(conn)
+
+	s.limitMux.Lock()
+	defer s.limitMux.Unlock()
+
+	s.activeConns--
+	if s.perSourceIP[host] <= 1 {
+		delete(s.perSourceIP, host)
+	} else {
+		s.perSourceIP[host]--
+	}
+}
+
+func sourceIP(conn *net.TCPConn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
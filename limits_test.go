@@ -0,0 +1,98 @@
+package socksy5
+
+import (
+	"net"
+	"testing"
+)
+
+func dialTCPPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return c.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+}
+
+func TestAdmitConnMaxConcurrent(t *testing.T) {
+	s := &Server{Limits: &Limits{MaxConcurrent: 1}}
+
+	_, srv1 := dialTCPPair(t)
+	defer srv1.Close()
+	_, srv2 := dialTCPPair(t)
+	defer srv2.Close()
+
+	if !s.admitConn(srv1) {
+		t.Fatal("first connection should be admitted")
+	}
+	if s.admitConn(srv2) {
+		t.Fatal("second connection should be rejected over MaxConcurrent")
+	}
+
+	s.releaseConn(srv1)
+	if !s.admitConn(srv2) {
+		t.Fatal("connection should be admitted after releaseConn frees a slot")
+	}
+}
+
+func TestAdmitConnMaxPerSourceIP(t *testing.T) {
+	s := &Server{Limits: &Limits{MaxPerSourceIP: 1}}
+
+	_, srv1 := dialTCPPair(t)
+	defer srv1.Close()
+	_, srv2 := dialTCPPair(t)
+	defer srv2.Close()
+
+	if !s.admitConn(srv1) {
+		t.Fatal("first connection from source IP should be admitted")
+	}
+	if s.admitConn(srv2) {
+		t.Fatal("second connection from same source IP should be rejected")
+	}
+}
+
+// TestConnReleaseHandoffDefersRelease guards against the slot being freed
+// the instant dispatch/serveClient return instead of when a handed-off
+// relay/association actually ends: done() must be a no-op once handoff()
+// has been called, and the slot must stay held until the returned release
+// func is invoked.
+func TestConnReleaseHandoffDefersRelease(t *testing.T) {
+	released := 0
+	cr := &connRelease{release: func() { released++ }}
+
+	release := cr.handoff()
+	cr.done()
+	if released != 0 {
+		t.Fatal("done() must not release a slot that's been handed off")
+	}
+
+	release()
+	if released != 1 {
+		t.Fatalf("expected the handed-off release func to release exactly once, got %d calls", released)
+	}
+}
+
+// TestConnReleaseDoneWithoutHandoff covers the common case: a request that
+// never starts a relay (denied, handshake failure, e.t.c.) must have its
+// slot released by done() alone.
+func TestConnReleaseDoneWithoutHandoff(t *testing.T) {
+	released := 0
+	cr := &connRelease{release: func() { released++ }}
+
+	cr.done()
+	if released != 1 {
+		t.Fatalf("expected done() to release once without a handoff, got %d calls", released)
+	}
+}
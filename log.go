@@ -0,0 +1,179 @@
+package socksy5
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// Verbosity levels below [slog.LevelDebug], used for the package's more
+// chatty internal tracing (dbgv/dbgvv).
+const (
+	LevelVerbose = slog.LevelDebug - 2
+	LevelTrace   = slog.LevelDebug - 4
+)
+
+// Stable attribute keys attached to log records emitted by a [Server], so
+// operators can filter/aggregate on them in an external observability
+// stack regardless of how the log line itself is worded.
+const (
+	AttrKeyCmd    = "socks5.cmd"
+	AttrKeyRep    = "socks5.rep"
+	AttrKeyRAddr  = "socks5.raddr"
+	AttrKeyLAddr  = "socks5.laddr"
+	AttrKeyMethod = "socks5.method"
+	AttrKeyStage  = "socks5.stage"
+)
+
+func cmdAttr(cmd byte) slog.Attr       { return slog.String(AttrKeyCmd, cmd2str(cmd)) }
+func repAttr(rep byte) slog.Attr       { return slog.String(AttrKeyRep, rep2str(rep)) }
+func methodAttr(m byte) slog.Attr      { return slog.String(AttrKeyMethod, method2Str(m)) }
+func stageAttr(stage string) slog.Attr { return slog.String(AttrKeyStage, stage) }
+
+// An OpError describes a single operation a [Server] performed or attempted
+// to perform. Target is typically the [net.Conn], [net.Listener] or
+// [net.Addr] the operation concerns, and may be nil. Attrs carries
+// additional structured fields (see the AttrKey* constants) attached by the
+// call site for [Server.SetLogger] consumers.
+type OpError struct {
+	Op     string
+	Target any
+	Err    error
+	Attrs  []slog.Attr
+}
+
+func newOpErr(op string, target any, err error, attrs ...slog.Attr) *OpError {
+	return &OpError{Op: op, Target: target, Err: err, Attrs: attrs}
+}
+
+func (e *OpError) Error() string {
+	if e.Err == nil {
+		return e.Op
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+// LogEntry is a single log record, kept for backward compatibility with
+// code that reads [Server.LogChan] directly. New integrations should
+// prefer [Server.SetLogger].
+type LogEntry struct {
+	Time  time.Time
+	Level slog.Level
+	Msg   string
+	Attrs []slog.Attr
+}
+
+// SetLogger routes all of this Server's internal logging through l instead
+// of the legacy log channel. Call it before [Server.Start] to catch early
+// log entries too. LogChan keeps working afterwards, but only receives
+// entries if l's handler is (or wraps) the one [Server.LogChan] itself
+// would install.
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.logger = l
+}
+
+// logChanHandler is a minimal [slog.Handler] that feeds [Server.LogChan],
+// preserving its original lossy-channel semantics: a full (or absent)
+// channel drops the record rather than blocking the log call site.
+type logChanHandler struct {
+	s      *Server
+	attrs  []slog.Attr
+	groups []string
+}
+
+func (h *logChanHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *logChanHandler) Handle(_ context.Context, r slog.Record) error {
+	h.s.mux.Lock()
+	ch := h.s.logChan
+	h.s.mux.Unlock()
+	if ch == nil {
+		return nil
+	}
+
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	select {
+	case ch <- LogEntry{Time: r.Time, Level: r.Level, Msg: r.Message, Attrs: attrs}:
+	default:
+	}
+	return nil
+}
+
+func (h *logChanHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logChanHandler{s: h.s, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...), groups: h.groups}
+}
+
+func (h *logChanHandler) WithGroup(name string) slog.Handler {
+	return &logChanHandler{s: h.s, attrs: h.attrs, groups: append(append([]string(nil), h.groups...), name)}
+}
+
+// effectiveLogger returns the logger internal log calls should emit
+// through: the one set via [Server.SetLogger] if any, otherwise a lazily
+// created logger backed by [Server.LogChan], so existing LogChan consumers
+// keep working untouched.
+func (s *Server) effectiveLogger() *slog.Logger {
+	s.mux.Lock()
+	if s.logger != nil {
+		l := s.logger
+		s.mux.Unlock()
+		return l
+	}
+	s.mux.Unlock()
+	return slog.New(&logChanHandler{s: s})
+}
+
+// emit is the common path behind info/warn/err/dbg/dbgv/dbgvv. Each
+// argument is either a plain value appended to the message, or an *OpError
+// whose own Attrs (and, when its Target is a [net.Conn], its local/remote
+// address) are promoted to structured slog attributes.
+func (s *Server) emit(level slog.Level, args []any) {
+	logger := s.effectiveLogger()
+	if !logger.Enabled(context.Background(), level) {
+		return
+	}
+
+	var msgParts []string
+	var attrs []slog.Attr
+	for _, a := range args {
+		switch v := a.(type) {
+		case nil:
+			continue
+		case *OpError:
+			msgParts = append(msgParts, v.Error())
+			attrs = append(attrs, v.Attrs...)
+			switch t := v.Target.(type) {
+			case net.Conn:
+				attrs = append(attrs, slog.String(AttrKeyLAddr, t.LocalAddr().String()), slog.String(AttrKeyRAddr, t.RemoteAddr().String()))
+			case net.Addr:
+				attrs = append(attrs, slog.String(AttrKeyLAddr, t.String()))
+			}
+		case error:
+			msgParts = append(msgParts, v.Error())
+		case string:
+			msgParts = append(msgParts, v)
+		default:
+			msgParts = append(msgParts, fmt.Sprint(v))
+		}
+	}
+
+	logger.LogAttrs(context.Background(), level, strings.Join(msgParts, " "), attrs...)
+}
+
+func (s *Server) dbgvv(args ...any) { s.emit(LevelTrace, args) }
+func (s *Server) dbgv(args ...any)  { s.emit(LevelVerbose, args) }
+func (s *Server) dbg(args ...any)   { s.emit(slog.LevelDebug, args) }
+func (s *Server) info(args ...any)  { s.emit(slog.LevelInfo, args) }
+func (s *Server) warn(args ...any)  { s.emit(slog.LevelWarn, args) }
+func (s *Server) err(args ...any)   { s.emit(slog.LevelError, args) }
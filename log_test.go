@@ -0,0 +1,65 @@
+package socksy5
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+)
+
+// recordingHandler is a minimal slog.Handler that captures every record
+// passed to it, so tests can assert what a Server actually logged without
+// depending on text formatting.
+type recordingHandler struct {
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+// TestSetLoggerRedirectsOutput guards against s.info/warn/err e.t.c.
+// falling back to the LogChan handler once SetLogger has been called,
+// instead of routing through the logger the caller asked for.
+func TestSetLoggerRedirectsOutput(t *testing.T) {
+	s := &Server{}
+	h := &recordingHandler{}
+	s.SetLogger(slog.New(h))
+
+	s.info(newOpErr("test op", nil, nil))
+
+	if len(h.records) != 1 {
+		t.Fatalf("expected 1 record delivered to the custom logger, got %d", len(h.records))
+	}
+	if h.records[0].Message != "test op" {
+		t.Fatalf("unexpected message %q", h.records[0].Message)
+	}
+}
+
+// TestLogChanReceivesViaHandlerAdapter guards against LogChan breaking as a
+// backward-compatible adapter once logging was rerouted through slog: with
+// no logger set, effectiveLogger must fall back to a logger backed by
+// logChanHandler so existing LogChan consumers keep working untouched.
+func TestLogChanReceivesViaHandlerAdapter(t *testing.T) {
+	s := &Server{}
+	ch := s.LogChan()
+
+	s.warn(newOpErr("test warning", nil, nil))
+
+	select {
+	case entry := <-ch:
+		if entry.Msg != "test warning" {
+			t.Fatalf("unexpected message %q", entry.Msg)
+		}
+		if entry.Level != slog.LevelWarn {
+			t.Fatalf("unexpected level %v", entry.Level)
+		}
+	default:
+		t.Fatal("LogChan received nothing")
+	}
+}
@@ -0,0 +1,140 @@
+package socksy5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var errNoKeepaliveSupport = errors.New("underlying connection does not support TCP keepalive")
+
+// protocolPeekSize is the number of bytes sniffed off a freshly accepted
+// connection before it is dispatched to a [ProtocolHandler] or to the
+// built-in SOCKS5 handshake.
+const protocolPeekSize = 8
+
+// A ProtocolHandler lets external code plug additional application
+// protocols into a [Server]'s listener, so a single TCP port can
+// transparently multiplex SOCKS5 with e.g. HTTP CONNECT, a forward HTTP
+// proxy, or TLS SNI routing. See [Server.RegisterProtocol].
+type ProtocolHandler interface {
+	// Detect reports whether peek, the first bytes read off a connection,
+	// look like this handler's protocol. peek may be shorter than
+	// [protocolPeekSize] if the client sent less than that before the
+	// connection was dispatched.
+	Detect(peek []byte) bool
+
+	// Serve takes over conn, whose Read side transparently replays the
+	// bytes already consumed by Detect. Serve owns conn's entire lifecycle,
+	// including closing it once done.
+	Serve(conn net.Conn)
+}
+
+// RegisterProtocol adds h to the set of protocols this Server dispatches
+// new connections to ahead of the built-in SOCKS5 handshake. Handlers are
+// tried in registration order; the first one whose Detect returns true wins
+// the connection. Connections that no handler claims fall back to the
+// SOCKS5 handshake, matched by [VerSOCKS5] as the first byte.
+//
+// RegisterProtocol is safe to call before or after [Server.Start], and safe
+// to call simultaneously with itself and with dispatch of incoming
+// connections.
+func (s *Server) RegisterProtocol(h ProtocolHandler) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.protocols = append(s.protocols, h)
+}
+
+// pushbackConn wraps a [net.Conn], replaying a slice of already-consumed
+// bytes to readers before falling through to the underlying connection.
+type pushbackConn struct {
+	net.Conn
+	peeked *bytes.Reader
+}
+
+// SetKeepAlive and SetKeepAlivePeriod let a pushbackConn be used wherever
+// [tcpKeepaliveConn] is expected, by delegating to the wrapped connection
+// if it supports them.
+func (c *pushbackConn) SetKeepAlive(keepalive bool) error {
+	kc, ok := c.Conn.(tcpKeepaliveConn)
+	if !ok {
+		return errNoKeepaliveSupport
+	}
+	return kc.SetKeepAlive(keepalive)
+}
+
+func (c *pushbackConn) SetKeepAlivePeriod(d time.Duration) error {
+	kc, ok := c.Conn.(tcpKeepaliveConn)
+	if !ok {
+		return errNoKeepaliveSupport
+	}
+	return kc.SetKeepAlivePeriod(d)
+}
+
+func (c *pushbackConn) Read(p []byte) (int, error) {
+	if c.peeked != nil {
+		n, err := c.peeked.Read(p)
+		if err == io.EOF {
+			c.peeked = nil
+			err = nil
+		}
+		if n > 0 {
+			return n, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+// dispatch sniffs the first bytes of a freshly accepted connection and
+// routes it to a registered [ProtocolHandler], falling back to the SOCKS5
+// handshake handled by serveClient.
+func (s *Server) dispatch(conn *net.TCPConn, cr *connRelease) {
+	if s.Limits != nil && s.Limits.HandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.Limits.HandshakeTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	peek := make([]byte, protocolPeekSize)
+	n, err := io.ReadAtLeast(conn, peek, 1)
+	peek = peek[:n]
+	if err != nil {
+		s.err(newOpErr("peek connection", conn, err))
+		s.closeCloser(conn)
+		return
+	}
+
+	pc := &pushbackConn{Conn: conn, peeked: bytes.NewReader(peek)}
+
+	s.mux.Lock()
+	protocols := s.protocols
+	s.mux.Unlock()
+
+	for _, h := range protocols {
+		if h.Detect(peek) {
+			s.dbgv(newOpErr(fmt.Sprintf("dispatch connection to protocol %T", h), conn, nil))
+			// HandshakeTimeout only bounds the sniff above, not whatever
+			// Serve does with conn for the rest of its lifetime — clear it
+			// before handing over, since our own deferred reset won't run
+			// until Serve returns.
+			conn.SetReadDeadline(time.Time{})
+			h.Serve(pc)
+			// Serve owns conn's lifecycle and closes it itself, but only
+			// this package's closers map knows about the registration
+			// listen() made; delete it now that Serve has returned, or it
+			// leaks forever.
+			s.delCloser(conn)
+			return
+		}
+	}
+
+	if peek[0] != VerSOCKS5 {
+		s.warn(newOpErr("dispatch connection", conn, fmt.Errorf("unrecognized protocol, first byte 0x%02x", peek[0])))
+		s.closeCloser(conn)
+		return
+	}
+
+	s.serveClient(pc, cr)
+}
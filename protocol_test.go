@@ -0,0 +1,95 @@
+package socksy5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type stubProtocolHandler struct {
+	served chan struct{}
+}
+
+func (h *stubProtocolHandler) Detect(peek []byte) bool { return true }
+
+func (h *stubProtocolHandler) Serve(conn net.Conn) {
+	conn.Close()
+	close(h.served)
+}
+
+// outlivingProtocolHandler is a ProtocolHandler whose Serve blocks on a read
+// well past HandshakeTimeout, to prove that timeout only bounds the sniff
+// phase and isn't left installed on conn for Serve's lifetime.
+type outlivingProtocolHandler struct {
+	readErr chan error
+}
+
+func (h *outlivingProtocolHandler) Detect(peek []byte) bool { return true }
+
+func (h *outlivingProtocolHandler) Serve(conn net.Conn) {
+	buf := make([]byte, 1)
+	// The first Read only replays the byte dispatch sniffed; the second is
+	// the one that waits on the wire past HandshakeTimeout.
+	if _, err := conn.Read(buf); err != nil {
+		h.readErr <- err
+		return
+	}
+	_, err := conn.Read(buf)
+	h.readErr <- err
+}
+
+// TestDispatchClearsHandshakeTimeoutBeforeProtocolHandler guards against
+// HandshakeTimeout's read deadline, installed by dispatch to bound the
+// sniff, still being in effect once a ProtocolHandler's Serve takes over —
+// Serve is documented to own conn's entire lifecycle and may well outlive
+// HandshakeTimeout.
+func TestDispatchClearsHandshakeTimeoutBeforeProtocolHandler(t *testing.T) {
+	s := &Server{
+		closers: make(map[closer]struct{}),
+		Limits:  &Limits{HandshakeTimeout: 10 * time.Millisecond},
+	}
+	h := &outlivingProtocolHandler{readErr: make(chan error, 1)}
+	s.protocols = append(s.protocols, h)
+
+	client, srv := dialTCPPair(t)
+	defer client.Close()
+	s.regCloser(srv)
+
+	go client.Write([]byte("x"))
+	go s.dispatch(srv, &connRelease{release: func() {}})
+
+	time.Sleep(50 * time.Millisecond)
+	go client.Write([]byte("y"))
+
+	select {
+	case err := <-h.readErr:
+		if err != nil {
+			t.Fatalf("Serve's Read failed after HandshakeTimeout elapsed, deadline wasn't cleared: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve's Read never returned")
+	}
+}
+
+// TestDispatchDeletesCloserAfterProtocolHandler guards against dispatch
+// leaking a permanent s.closers entry for every connection a
+// ProtocolHandler serves: regCloser(conn) is done back in listen(), but
+// Serve only has access to the wrapped pushbackConn, so dispatch itself
+// must delete the entry once Serve returns.
+func TestDispatchDeletesCloserAfterProtocolHandler(t *testing.T) {
+	s := &Server{closers: make(map[closer]struct{})}
+	h := &stubProtocolHandler{served: make(chan struct{})}
+	s.protocols = append(s.protocols, h)
+
+	client, srv := dialTCPPair(t)
+	defer client.Close()
+	s.regCloser(srv)
+
+	go client.Write([]byte("x"))
+	s.dispatch(srv, &connRelease{release: func() {}})
+
+	<-h.served
+	if _, ok := s.closers[srv]; ok {
+		t.Fatal("dispatch left conn registered in s.closers after a ProtocolHandler served it")
+	}
+}
@@ -15,9 +15,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // Constants for server policy.
@@ -40,11 +44,48 @@ type Server struct {
 	listener    *net.TCPListener
 	mux         sync.Mutex
 	logChan     chan LogEntry
+	logger      *slog.Logger
 	hndshkChan  chan *Handshake
 	requestChan chan any
 	started     bool
 	down        bool
 	closers     map[closer]struct{}
+	protocols   []ProtocolHandler
+
+	limitMux      sync.Mutex
+	acceptLimiter *rate.Limiter
+	perSourceIP   map[string]int
+	activeConns   int
+
+	statHandshakes int64
+	statConnects   int64
+	statBinds      int64
+	statAssocs     int64
+	statBytes      int64
+
+	// Keepalive, if non-nil, enables TCP keepalive and periodic liveness
+	// probing on CONNECT and BIND relays. See [KeepaliveConfig].
+	Keepalive *KeepaliveConfig
+
+	// RelayIdleTimeout, if positive, tears a CONNECT or BIND relay down
+	// once either of its two legs has gone this long without receiving any
+	// data, even if the other direction is still carrying traffic.
+	RelayIdleTimeout time.Duration
+
+	// DefaultDialer, if non-nil, is used to dial the outbound leg of a
+	// CONNECT request whose external handler hasn't already attached a
+	// connection. It is never consulted for BIND, whose outbound leg is an
+	// inbound connection the Server passively awaits, not one it dials. See
+	// [Dialer].
+	DefaultDialer Dialer
+
+	// DialTimeout bounds how long Server.DefaultDialer is given to dial
+	// before the request is failed. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// Limits, if non-nil, caps the number of connections and handshake
+	// rate this Server accepts. See [Limits].
+	Limits *Limits
 }
 
 // Start starts the Server. No-op if it has been started.
@@ -62,6 +103,10 @@ func (s *Server) Start(addr string) (err error) {
 	}
 	s.started = true // mux is not needed here
 
+	if s.Limits != nil && s.Limits.AcceptRate > 0 {
+		s.acceptLimiter = rate.NewLimiter(s.Limits.AcceptRate, 1)
+	}
+
 	s.regCloser(s.listener)
 	s.info(nil, "server started, listening for", s.listener.Addr())
 
@@ -149,6 +194,10 @@ func (s *Server) closeCloser(c closer) error {
 	return err
 }
 
+// LogChan returns a channel of this Server's log entries. It is a thin
+// [slog.Handler] wrapper kept for backward compatibility; prefer
+// [Server.SetLogger] for routing logs into an existing observability
+// stack (JSON, Loki, OpenTelemetry) instead of polling a lossy channel.
 func (s *Server) LogChan() <-chan LogEntry {
 	s.mux.Lock()
 	defer s.mux.Unlock()
@@ -192,14 +241,45 @@ func (s *Server) listen() {
 			return
 		}
 
+		if !s.admitConn(conn) {
+			s.warn(newOpErr("reject connection (limits exceeded)", conn, nil, stageAttr("accept")))
+			conn.Close()
+			continue
+		}
+
 		s.info(newOpErr("new connection", conn, nil))
 		s.regCloser(conn)
 
-		go s.serveClient(conn)
+		cr := &connRelease{release: func() { s.releaseConn(conn) }}
+		go func() {
+			defer cr.done()
+			s.dispatch(conn, cr)
+		}()
 	}
 }
 
-func (s *Server) serveClient(conn *net.TCPConn) {
+func (s *Server) serveClient(conn net.Conn, cr *connRelease) {
+	var handshakeTimer *time.Timer
+	if s.Limits != nil && s.Limits.HandshakeTimeout > 0 {
+		handshakeTimer = time.AfterFunc(s.Limits.HandshakeTimeout, func() {
+			s.warn(newOpErr("handshake timeout", conn, nil, stageAttr("handshake")))
+			s.closeCloser(conn)
+		})
+	}
+
+	atomic.AddInt64(&s.statHandshakes, 1)
+	// handshakeDone also ends HandshakeTimeout's hold on conn: the timer
+	// and the read deadline dispatch installed stop once subnegotiation is
+	// done, so they don't cut into the request stage.
+	handshakeDone := sync.OnceFunc(func() {
+		atomic.AddInt64(&s.statHandshakes, -1)
+		if handshakeTimer != nil {
+			handshakeTimer.Stop()
+			conn.SetReadDeadline(time.Time{})
+		}
+	})
+	defer handshakeDone()
+
 	hs, err := readHandshake(conn)
 	if err != nil {
 		s.err(newOpErr("read handshake", conn, err))
@@ -212,7 +292,7 @@ func (s *Server) serveClient(conn *net.TCPConn) {
 	time.AfterFunc(PeriodAutoDeny, func() {
 		hs.deny(true)
 	})
-	s.dbgv(newOpErr("select method from one of ", conn, nil))
+	s.dbgv(newOpErr("select method from one of ", conn, nil, stageAttr("handshake")))
 	sent := s.selectMethod(&hs)
 
 	if !sent || hs.timeoutDeny {
@@ -221,7 +301,7 @@ func (s *Server) serveClient(conn *net.TCPConn) {
 		return
 	}
 
-	s.dbgv(newOpErr("selected method "+method2Str(hs.methodChosen), conn, nil))
+	s.dbgv(newOpErr("selected method "+method2Str(hs.methodChosen), conn, nil, stageAttr("handshake"), methodAttr(hs.methodChosen)))
 
 	hsReply := []byte{VerSOCKS5, hs.methodChosen}
 	if _, err := conn.Write(hsReply); err != nil {
@@ -256,6 +336,7 @@ func (s *Server) serveClient(conn *net.TCPConn) {
 	if capper == nil {
 		capper = NoCap{}
 	}
+	handshakeDone()
 	s.dbgv(newOpErr(fmt.Sprintf("using capsulation %T", capper), conn, nil))
 
 	req, err := readRequest(capper)
@@ -265,8 +346,8 @@ func (s *Server) serveClient(conn *net.TCPConn) {
 		return
 	}
 
-	s.dbg(newOpErr("received request "+cmd2str(req.cmd), conn, nil))
-	s.dbgv(newOpErr("reply to request sent", conn, nil))
+	s.dbg(newOpErr("received request "+cmd2str(req.cmd), conn, nil, stageAttr("request"), cmdAttr(req.cmd)))
+	s.dbgv(newOpErr("reply to request sent", conn, nil, stageAttr("request"), cmdAttr(req.cmd)))
 
 	req.laddr = conn.LocalAddr()
 	req.raddr = conn.RemoteAddr()
@@ -328,31 +409,46 @@ func (s *Server) serveClient(conn *net.TCPConn) {
 		s.warn(newOpErr("serve", conn, &RequestNotHandledError{Type: cmd2str(req.cmd), Timeout: true}))
 	}
 
-	s.dbg(newOpErr(fmt.Sprintf("reply %s to request %s", rep2str(req.reply.rep), cmd2str(req.cmd)), conn, nil))
+	// A CONNECT accepted with no conn attached and DefaultDialer set hasn't
+	// actually dialed yet — handleConnect does that, and only then knows
+	// the real BND.ADDR (or whether the dial failed), so it must own
+	// writing this reply instead of the generic write below sending a
+	// premature RepSucceeded with a zero address.
+	connReq, deferConnectReply := wrappedReq.(*ConnectRequest)
+	deferConnectReply = deferConnectReply && req.reply.rep == RepSucceeded && connReq.conn == nil && s.DefaultDialer != nil
 
-	raw, _ := req.reply.MarshalBinary()
-	if _, err := capper.Write(raw); err != nil {
-		s.err(newOpErr("reply request", conn, err))
-		s.closeCloser(conn)
-		return
-	}
+	if !deferConnectReply {
+		s.dbg(newOpErr(fmt.Sprintf("reply %s to request %s", rep2str(req.reply.rep), cmd2str(req.cmd)), conn, nil, stageAttr("request"), cmdAttr(req.cmd), repAttr(req.reply.rep)))
+
+		raw, _ := req.reply.MarshalBinary()
+		if _, err := capper.Write(raw); err != nil {
+			s.err(newOpErr("reply request", conn, err))
+			s.closeCloser(conn)
+			return
+		}
 
-	if req.reply.rep != RepSucceeded {
-		s.dbg(newOpErr(fmt.Sprintf("reply %s to request %s", rep2str(req.reply.rep), cmd2str(req.cmd)), conn, nil))
+		if req.reply.rep != RepSucceeded {
+			s.dbg(newOpErr(fmt.Sprintf("reply %s to request %s", rep2str(req.reply.rep), cmd2str(req.cmd)), conn, nil, stageAttr("request"), cmdAttr(req.cmd), repAttr(req.reply.rep)))
+		}
 	}
 
 	switch req.cmd {
 	case CmdCONNECT:
-		s.handleConnect(wrappedReq.(*ConnectRequest), capper, conn)
+		s.handleConnect(wrappedReq.(*ConnectRequest), capper, conn, cr, deferConnectReply)
 	case CmdBIND:
-		s.handleBind(wrappedReq.(*BindRequest), capper, conn)
+		s.handleBind(wrappedReq.(*BindRequest), capper, conn, cr)
 	case CmdASSOC:
-		s.handleAssoc(wrappedReq.(*AssocRequest), conn)
+		s.handleAssoc(wrappedReq.(*AssocRequest), conn, cr)
 	}
 	return
 }
 
-func (s *Server) handleConnect(r *ConnectRequest, capper Capsulator, conn net.Conn) {
+// handleConnect dials r's outbound leg via s.DefaultDialer when the request
+// was accepted with no conn attached, then relays. deferReply is true when
+// serveClient held off writing the CONNECT reply because the real
+// BND.ADDR, or whether the dial even succeeds, isn't known until the dial
+// above resolves; handleConnect then owns writing that reply itself.
+func (s *Server) handleConnect(r *ConnectRequest, capper Capsulator, conn net.Conn, cr *connRelease, deferReply bool) {
 	if r.reply.rep != RepSucceeded {
 		time.AfterFunc(PeriodClose, func() {
 			s.closeCloser(r.conn)
@@ -361,11 +457,44 @@ func (s *Server) handleConnect(r *ConnectRequest, capper Capsulator, conn net.Co
 		return
 	}
 
+	if deferReply {
+		if !s.dialOutbound(func(c net.Conn) { r.conn = c }, r.dst, conn) {
+			r.reply.rep = RepGeneralFailure
+			raw, _ := r.reply.MarshalBinary()
+			s.dbg(newOpErr(fmt.Sprintf("reply %s to request %s", rep2str(r.reply.rep), cmd2str(CmdCONNECT)), conn, nil, stageAttr("request"), cmdAttr(CmdCONNECT), repAttr(r.reply.rep)))
+			capper.Write(raw)
+			return
+		}
+
+		if bndAddr, err := addrFromNetAddr(r.conn.LocalAddr()); err == nil {
+			r.reply.addr = bndAddr
+		}
+
+		s.dbg(newOpErr(fmt.Sprintf("reply %s to request %s", rep2str(r.reply.rep), cmd2str(CmdCONNECT)), conn, nil, stageAttr("request"), cmdAttr(CmdCONNECT), repAttr(r.reply.rep)))
+		raw, _ := r.reply.MarshalBinary()
+		if _, err := capper.Write(raw); err != nil {
+			s.err(newOpErr("reply request", conn, err))
+			s.closeCloser(conn)
+			return
+		}
+	}
+
 	s.regCloser(r.conn)
 
-	s.info(newOpErr("relay CONNECT started "+relay2str(conn, r.conn), nil, nil))
+	s.info(newOpErr("relay CONNECT started "+relay2str(conn, r.conn), nil, nil, stageAttr("relay"), cmdAttr(CmdCONNECT)))
+
+	relayDone, ga, gb := s.watchRelayKeepalive(conn, r.conn)
+	a := s.wrapRelayIdle(ga.wrap(capper), conn)
+	b := s.wrapRelayIdle(gb.wrap(r.conn), r.conn)
 
-	go s.relay(capper, r.conn, func(err error) {
+	release := cr.handoff()
+	atomic.AddInt64(&s.statConnects, 1)
+	go s.relay(a, b, func(err error) {
+		close(relayDone)
+		s.closeCloser(conn)
+		s.closeCloser(r.conn)
+		atomic.AddInt64(&s.statConnects, -1)
+		release()
 		if err != nil {
 			s.err(newOpErr("relay CONNECT "+relay2str(conn, r.conn), nil, err))
 		} else {
@@ -374,7 +503,7 @@ func (s *Server) handleConnect(r *ConnectRequest, capper Capsulator, conn net.Co
 	})
 }
 
-func (s *Server) handleBind(r *BindRequest, capper Capsulator, conn net.Conn) {
+func (s *Server) handleBind(r *BindRequest, capper Capsulator, conn net.Conn, cr *connRelease) {
 	if r.reply.rep != RepSucceeded {
 		time.AfterFunc(PeriodClose, func() {
 			s.closeCloser(r.conn)
@@ -399,9 +528,20 @@ func (s *Server) handleBind(r *BindRequest, capper Capsulator, conn net.Conn) {
 		return
 	}
 
-	s.info(newOpErr("relay BND started "+relay2str(conn, r.conn), nil, nil))
+	s.info(newOpErr("relay BND started "+relay2str(conn, r.conn), nil, nil, stageAttr("relay"), cmdAttr(CmdBIND)))
 
-	go s.relay(capper, r.conn, func(err error) {
+	relayDone, ga, gb := s.watchRelayKeepalive(conn, r.conn)
+	a := s.wrapRelayIdle(ga.wrap(capper), conn)
+	b := s.wrapRelayIdle(gb.wrap(r.conn), r.conn)
+
+	release := cr.handoff()
+	atomic.AddInt64(&s.statBinds, 1)
+	go s.relay(a, b, func(err error) {
+		close(relayDone)
+		s.closeCloser(conn)
+		s.closeCloser(r.conn)
+		atomic.AddInt64(&s.statBinds, -1)
+		release()
 		if err != nil {
 			s.err(newOpErr("relay BND  "+relay2str(conn, r.conn), nil, err))
 		} else {
@@ -410,13 +550,26 @@ func (s *Server) handleBind(r *BindRequest, capper Capsulator, conn net.Conn) {
 	})
 }
 
-func (s *Server) handleAssoc(r *AssocRequest, conn net.Conn) {
+func (s *Server) handleAssoc(r *AssocRequest, conn net.Conn, cr *connRelease) {
 	if r.reply.rep != RepSucceeded {
 		time.AfterFunc(PeriodClose, func() {
 			s.closeCloser(conn)
 			r.terminate()
 		})
+		return
 	}
+
+	release := cr.handoff()
+	atomic.AddInt64(&s.statAssocs, 1)
+	chainNotify(r, func(prev func(error)) func(error) {
+		return func(err error) {
+			atomic.AddInt64(&s.statAssocs, -1)
+			release()
+			if prev != nil {
+				prev(err)
+			}
+		}
+	})
 }
 
 func (s *Server) selectMethod(hs *Handshake) (sent bool) {
@@ -455,7 +608,8 @@ func (s *Server) relay(a, b io.ReadWriter, onErr func(error)) {
 	once := sync.Once{}
 
 	cpy := func(dst io.Writer, src io.Reader) {
-		_, err := io.Copy(dst, src)
+		n, err := io.Copy(dst, src)
+		atomic.AddInt64(&s.statBytes, n)
 		once.Do(func() {
 			onErr(err)
 		})
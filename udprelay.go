@@ -0,0 +1,304 @@
+package socksy5
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxUDPPacketSize is the default ceiling on the size of a single UDP
+// datagram handled by [AssocRequest.AcceptAndRelay]. Datagrams larger than
+// the configured (or default) max are dropped.
+const MaxUDPPacketSize = 64 * 1024
+
+// UDPRelayOptions configures the built-in UDP relay started by
+// [AssocRequest.AcceptAndRelay].
+type UDPRelayOptions struct {
+	// IdleTimeout tears the relay down if no datagram has been exchanged in
+	// either direction for this long. Zero means no idle timeout.
+	IdleTimeout time.Duration
+
+	// MaxPacketSize caps the size of datagrams read off the wire, in either
+	// direction. Oversized datagrams are dropped. Zero uses
+	// [MaxUDPPacketSize].
+	MaxPacketSize int
+
+	// PacketFilter, when non-nil, is consulted for every client->remote
+	// datagram after the RFC 1928 §7 header has been parsed and stripped.
+	// Returning false drops the datagram silently.
+	PacketFilter func(dst Addr, payload []byte) bool
+}
+
+func (o *UDPRelayOptions) maxPacketSize() int {
+	if o == nil || o.MaxPacketSize <= 0 {
+		return MaxUDPPacketSize
+	}
+	return o.MaxPacketSize
+}
+
+func (o *UDPRelayOptions) idleTimeout() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.IdleTimeout
+}
+
+func (o *UDPRelayOptions) filter(dst Addr, payload []byte) bool {
+	if o == nil || o.PacketFilter == nil {
+		return true
+	}
+	return o.PacketFilter(dst, payload)
+}
+
+// notifyMux serializes read-modify-write access to AssocRequest.notify.
+// AcceptAndRelay wraps it from the goroutine external code is told to run it
+// in, while Server.handleAssoc wraps it concurrently from the connection's
+// own goroutine right after Accept unblocks; without a lock, whichever
+// write loses silently drops the other's wrapping.
+var notifyMux sync.Mutex
+
+// chainNotify atomically replaces r.notify with wrap applied to its current
+// value, so concurrent callers chaining onto notify never clobber one
+// another.
+func chainNotify(r *AssocRequest, wrap func(prev func(error)) func(error)) {
+	notifyMux.Lock()
+	defer notifyMux.Unlock()
+	r.notify = wrap(r.notify)
+}
+
+// udpRelay holds the state of one built-in UDP relay started by
+// [AssocRequest.AcceptAndRelay].
+type udpRelay struct {
+	conn      *net.UDPConn
+	opts      *UDPRelayOptions
+	clientSet atomic.Bool
+	clientMux sync.RWMutex
+	client    *net.UDPAddr
+	closeOnce sync.Once
+
+	targetMux sync.RWMutex
+	targets   map[string]struct{}
+}
+
+// AcceptAndRelay accepts the UDP ASSOCIATE request by binding a UDP socket
+// to bindAddr, replies to the client with the socket's local address, and
+// then relays RFC 1928 §7 datagrams between the client and whatever remote
+// hosts it targets for the lifetime of the association.
+//
+// Datagrams with FRAG != 0 are dropped, since reassembly is out of scope for
+// the built-in relay. The client's UDP source address is learned from the
+// first datagram received and pinned for the rest of the association. A
+// datagram from any other source is only relayed to the client if the
+// client has itself previously sent a datagram to that address; anything
+// else is dropped, so a third party that reaches the relay's bound UDP
+// port can't inject spoofed "replies".
+//
+// AcceptAndRelay blocks until the relay is torn down, either because opts'
+// idle timeout elapsed or because the associated TCP control connection
+// died. Call it in its own goroutine right after receiving the
+// [*AssocRequest] from [Server.RequestChan].
+func (r *AssocRequest) AcceptAndRelay(bindAddr string, opts *UDPRelayOptions) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", bindAddr)
+	if err != nil {
+		r.Deny(RepGeneralFailure, emptyAddr)
+		return fmt.Errorf("resolve bind addr: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		r.Deny(RepGeneralFailure, emptyAddr)
+		return fmt.Errorf("listen udp: %w", err)
+	}
+
+	localAddr, err := addrFromNetAddr(conn.LocalAddr())
+	if err != nil {
+		conn.Close()
+		r.Deny(RepGeneralFailure, emptyAddr)
+		return fmt.Errorf("resolve local addr: %w", err)
+	}
+
+	if err := r.Accept(localAddr); err != nil {
+		conn.Close()
+		return err
+	}
+
+	rel := &udpRelay{conn: conn, opts: opts}
+
+	chainNotify(r, func(prev func(error)) func(error) {
+		return func(err error) {
+			rel.close()
+			if prev != nil {
+				prev(err)
+			}
+		}
+	})
+
+	rel.serve()
+	return nil
+}
+
+func (rel *udpRelay) close() {
+	rel.closeOnce.Do(func() {
+		rel.conn.Close()
+	})
+}
+
+func (rel *udpRelay) serve() {
+	defer rel.close()
+
+	idle := rel.opts.idleTimeout()
+	if idle > 0 {
+		rel.conn.SetReadDeadline(time.Now().Add(idle))
+	}
+
+	maxSize := rel.opts.maxPacketSize()
+	// buf is sized one byte past maxSize so an oversized datagram can
+	// actually be detected: ReadFromUDP silently discards whatever doesn't
+	// fit in buf, returning n == len(buf) and a nil error, not a truncation
+	// error, so a buf sized to exactly maxSize can never tell a full-size
+	// datagram from a truncated, corrupted one.
+	buf := make([]byte, maxSize+1)
+	for {
+		n, from, err := rel.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if idle > 0 {
+			rel.conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		if n > maxSize {
+			continue
+		}
+
+		if rel.isClient(from) {
+			rel.pinClient(from)
+			rel.relayToRemote(buf[:n])
+			continue
+		}
+
+		// A datagram from neither the pinned client nor a remote host the
+		// client has itself targeted is either stray traffic or a spoofed
+		// "reply" from an unrelated third party; drop it rather than
+		// forwarding it to the client as if it came from dst.
+		if rel.targeted(from) {
+			rel.relayToClient(from, buf[:n])
+		}
+	}
+}
+
+func (rel *udpRelay) pinClient(from *net.UDPAddr) {
+	if rel.clientSet.CompareAndSwap(false, true) {
+		rel.clientMux.Lock()
+		rel.client = from
+		rel.clientMux.Unlock()
+	}
+}
+
+// isClient reports whether from is the relay's client: the pinned client
+// address, or any source at all before the client has been pinned (the
+// first datagram received is always assumed to be the client's).
+func (rel *udpRelay) isClient(from *net.UDPAddr) bool {
+	if !rel.clientSet.Load() {
+		return true
+	}
+	rel.clientMux.RLock()
+	client := rel.client
+	rel.clientMux.RUnlock()
+	return client != nil && udpAddrEqual(client, from)
+}
+
+// addTarget records addr as a destination the client has sent a datagram
+// to, so a later reply from addr is recognized as genuine in targeted.
+func (rel *udpRelay) addTarget(addr *net.UDPAddr) {
+	rel.targetMux.Lock()
+	defer rel.targetMux.Unlock()
+	if rel.targets == nil {
+		rel.targets = make(map[string]struct{})
+	}
+	rel.targets[addr.String()] = struct{}{}
+}
+
+// targeted reports whether the client has previously sent a datagram to
+// addr, i.e. whether a datagram arriving from addr is an expected reply
+// rather than unsolicited traffic from an unrelated source.
+func (rel *udpRelay) targeted(addr *net.UDPAddr) bool {
+	rel.targetMux.RLock()
+	defer rel.targetMux.RUnlock()
+	_, ok := rel.targets[addr.String()]
+	return ok
+}
+
+// relayToRemote parses and strips the RFC 1928 §7 header off a datagram
+// received from the client and forwards the payload to DST.ADDR:DST.PORT.
+func (rel *udpRelay) relayToRemote(pkt []byte) {
+	if len(pkt) < 4 {
+		return
+	}
+	if pkt[2] != 0 {
+		// FRAG != 0: fragmentation is not supported by the built-in relay.
+		return
+	}
+
+	br := bytes.NewReader(pkt[3:])
+	dst, err := readAddr(br)
+	if err != nil {
+		return
+	}
+
+	payload := pkt[len(pkt)-br.Len():]
+	if !rel.opts.filter(dst, payload) {
+		return
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", dst.String())
+	if err != nil {
+		return
+	}
+	rel.addTarget(raddr)
+	rel.conn.WriteToUDP(payload, raddr)
+}
+
+// relayToClient wraps a datagram received from a remote host in the RFC
+// 1928 §7 header and forwards it to the pinned client.
+func (rel *udpRelay) relayToClient(from *net.UDPAddr, payload []byte) {
+	if !rel.clientSet.Load() {
+		return
+	}
+	rel.clientMux.RLock()
+	client := rel.client
+	rel.clientMux.RUnlock()
+	if client == nil {
+		return
+	}
+
+	src, err := addrFromNetAddr(from)
+	if err != nil {
+		return
+	}
+	rawAddr, err := src.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	hdr := make([]byte, 3, 3+len(rawAddr)+len(payload))
+	pkt := append(hdr, rawAddr...)
+	pkt = append(pkt, payload...)
+	rel.conn.WriteToUDP(pkt, client)
+}
+
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// addrFromNetAddr converts a [net.Addr] (as returned by e.g.
+// [net.UDPConn.LocalAddr]) into an [Addr] suitable for a SOCKS5 reply.
+func addrFromNetAddr(na net.Addr) (Addr, error) {
+	host, port, err := net.SplitHostPort(na.String())
+	if err != nil {
+		return emptyAddr, err
+	}
+	return ParseAddr(net.JoinHostPort(host, port))
+}
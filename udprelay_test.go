@@ -0,0 +1,112 @@
+package socksy5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mustResolveUDP(t *testing.T, s string) *net.UDPAddr {
+	t.Helper()
+	a, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		t.Fatalf("resolve %s: %v", s, err)
+	}
+	return a
+}
+
+// TestUDPRelayDropsUntargetedSource guards against the spoofing hole where
+// any datagram from a source other than the pinned client was relayed to
+// the client as if it were a reply, regardless of whether the client had
+// ever sent anything to that source.
+func TestUDPRelayDropsUntargetedSource(t *testing.T) {
+	rel := &udpRelay{}
+	client := mustResolveUDP(t, "127.0.0.1:1111")
+	remote := mustResolveUDP(t, "203.0.113.1:53")
+	spoofer := mustResolveUDP(t, "203.0.113.2:53")
+
+	if !rel.isClient(client) {
+		t.Fatal("first datagram should be treated as from the client before pinning")
+	}
+	rel.pinClient(client)
+
+	if rel.isClient(spoofer) {
+		t.Fatal("spoofer must not be treated as the pinned client")
+	}
+	if rel.targeted(remote) {
+		t.Fatal("remote should not be targeted before the client has sent it anything")
+	}
+
+	rel.addTarget(remote)
+
+	if !rel.targeted(remote) {
+		t.Fatal("remote the client sent to should be a recognized target")
+	}
+	if rel.targeted(spoofer) {
+		t.Fatal("a source the client never targeted must not be treated as a reply")
+	}
+}
+
+// TestUDPRelayDropsOversizedDatagram guards against an oversized datagram
+// being silently truncated by the kernel (ReadFromUDP returns n ==
+// len(buf), err == nil, with the excess bytes discarded) and then relayed
+// as if it were a complete, merely corrupted packet — instead of actually
+// being dropped as MaxPacketSize's doc promises.
+func TestUDPRelayDropsOversizedDatagram(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", mustResolveUDP(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("listen relay socket: %v", err)
+	}
+	defer serverConn.Close()
+
+	remoteConn, err := net.ListenUDP("udp", mustResolveUDP(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("listen remote socket: %v", err)
+	}
+	defer remoteConn.Close()
+	remoteAddr, err := ParseAddr(remoteConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("parse remote addr: %v", err)
+	}
+
+	clientConn, err := net.ListenUDP("udp", mustResolveUDP(t, "127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("listen client socket: %v", err)
+	}
+	defer clientConn.Close()
+
+	const maxSize = 32
+	rel := &udpRelay{conn: serverConn, opts: &UDPRelayOptions{MaxPacketSize: maxSize}}
+	go rel.serve()
+	defer rel.close()
+
+	header := func(dst Addr) []byte {
+		raw, err := dst.MarshalBinary()
+		if err != nil {
+			t.Fatalf("marshal dst addr: %v", err)
+		}
+		return append([]byte{0, 0, 0}, raw...)
+	}
+
+	oversized := append(header(remoteAddr), make([]byte, maxSize)...) // payload alone already fills maxSize, so header+payload exceeds it
+	if _, err := clientConn.WriteToUDP(oversized, serverConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("send oversized datagram: %v", err)
+	}
+
+	// A well-formed, in-budget datagram sent right after must still relay
+	// normally: the oversized read must not corrupt the relay loop.
+	okPkt := append(header(remoteAddr), []byte("hi")...)
+	if _, err := clientConn.WriteToUDP(okPkt, serverConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("send in-budget datagram: %v", err)
+	}
+
+	remoteConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxSize+1)
+	n, _, err := remoteConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("remote never received the in-budget datagram: %v", err)
+	}
+	if got := string(buf[:n]); got != "hi" {
+		t.Fatalf("remote got %q, want the in-budget datagram's payload, not a truncated oversized one", got)
+	}
+}